@@ -0,0 +1,88 @@
+package v1alpha3
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// GroupName is the group name used in this package's API objects
+const GroupName = "flagger.app"
+
+// SchemeGroupVersion is the group version used to register these objects
+var SchemeGroupVersion = schema.GroupVersion{Group: GroupName, Version: "v1alpha3"}
+
+// CanaryKind is the Canary CRD kind
+const CanaryKind = "Canary"
+
+// Canary is a progressive delivery custom resource
+type Canary struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   CanarySpec   `json:"spec"`
+	Status CanaryStatus `json:"status,omitempty"`
+}
+
+// CanarySpec defines the desired state of a Canary
+type CanarySpec struct {
+	TargetRef      LocalObjectReference `json:"targetRef"`
+	Service        CanaryService        `json:"service"`
+	CanaryAnalysis CanaryAnalysis       `json:"canaryAnalysis"`
+}
+
+// CanaryStatus defines the observed state of a Canary
+type CanaryStatus struct{}
+
+// LocalObjectReference references an object in the same namespace
+type LocalObjectReference struct {
+	Name string `json:"name"`
+}
+
+// CanaryService defines how a canary is exposed to traffic
+type CanaryService struct {
+	Port        int32              `json:"port"`
+	PortName    string             `json:"portName,omitempty"`
+	AppProtocol string             `json:"appProtocol,omitempty"`
+	Timeout     string             `json:"timeout,omitempty"`
+	Retries     *HTTPRetry         `json:"retries,omitempty"`
+	Match       []HTTPMatchRequest `json:"match,omitempty"`
+}
+
+// HTTPMatchRequest mirrors the subset of Istio's HTTPMatchRequest Flagger
+// uses to derive a router's path prefix
+type HTTPMatchRequest struct {
+	Uri *StringMatch `json:"uri,omitempty"`
+}
+
+// HTTPRetry configures retry behaviour for the canary's traffic
+type HTTPRetry struct {
+	Attempts      int    `json:"attempts"`
+	PerTryTimeout string `json:"perTryTimeout,omitempty"`
+}
+
+// CanaryAnalysis defines the validation process of a canary release
+type CanaryAnalysis struct {
+	// Match adds a route whose conditions are the path prefix plus every
+	// header match of every entry here, all of which must hold; that route
+	// carries the same primary/canary weights as the default route
+	Match []CanaryMatch `json:"match,omitempty"`
+
+	// NotMatch adds the negation of each of these header matches to that
+	// same route, so it only matches requests where none of the listed
+	// header values match, letting operators A/B on "header X not equal to
+	// Y". Only Exact can be negated; Prefix, Suffix and Regex are rejected
+	NotMatch []CanaryMatch `json:"notMatch,omitempty"`
+}
+
+// CanaryMatch is a set of header matches that must all be satisfied
+type CanaryMatch struct {
+	Headers map[string]StringMatch `json:"headers,omitempty"`
+}
+
+// StringMatch describes how a header value should be matched
+type StringMatch struct {
+	Exact  string `json:"exact,omitempty"`
+	Prefix string `json:"prefix,omitempty"`
+	Suffix string `json:"suffix,omitempty"`
+	Regex  string `json:"regex,omitempty"`
+}
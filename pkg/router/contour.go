@@ -1,7 +1,9 @@
 package router
 
 import (
+	"encoding/json"
 	"fmt"
+	"strings"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
@@ -9,6 +11,7 @@ import (
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
 
 	flaggerv1 "github.com/weaveworks/flagger/pkg/apis/flagger/v1alpha3"
@@ -30,75 +33,9 @@ func (cr *ContourRouter) Reconcile(canary *flaggerv1.Canary) error {
 	primaryName := fmt.Sprintf("%s-primary", targetName)
 	canaryName := fmt.Sprintf("%s-canary", targetName)
 
-	newSpec := contourv1.HTTPProxySpec{
-		Routes: []contourv1.Route{
-			{
-				Conditions: []contourv1.Condition{
-					{
-						Prefix: cr.makePrefix(canary),
-					},
-				},
-				TimeoutPolicy: cr.makeTimeoutPolicy(canary),
-				RetryPolicy:   cr.makeRetryPolicy(canary),
-				Services: []contourv1.Service{
-					{
-						Name:   primaryName,
-						Port:   int(canary.Spec.Service.Port),
-						Weight: uint32(100),
-					},
-					{
-						Name:   canaryName,
-						Port:   int(canary.Spec.Service.Port),
-						Weight: uint32(0),
-					},
-				},
-			},
-		},
-	}
-
-	if len(canary.Spec.CanaryAnalysis.Match) > 0 {
-		newSpec = contourv1.HTTPProxySpec{
-			Routes: []contourv1.Route{
-				{
-					Conditions:    cr.makeConditions(canary),
-					TimeoutPolicy: cr.makeTimeoutPolicy(canary),
-					RetryPolicy:   cr.makeRetryPolicy(canary),
-					Services: []contourv1.Service{
-						{
-							Name:   primaryName,
-							Port:   int(canary.Spec.Service.Port),
-							Weight: uint32(100),
-						},
-						{
-							Name:   canaryName,
-							Port:   int(canary.Spec.Service.Port),
-							Weight: uint32(0),
-						},
-					},
-				},
-				{
-					Conditions: []contourv1.Condition{
-						{
-							Prefix: cr.makePrefix(canary),
-						},
-					},
-					TimeoutPolicy: cr.makeTimeoutPolicy(canary),
-					RetryPolicy:   cr.makeRetryPolicy(canary),
-					Services: []contourv1.Service{
-						{
-							Name:   primaryName,
-							Port:   int(canary.Spec.Service.Port),
-							Weight: uint32(100),
-						},
-						{
-							Name:   canaryName,
-							Port:   int(canary.Spec.Service.Port),
-							Weight: uint32(0),
-						},
-					},
-				},
-			},
-		}
+	newSpec, err := cr.makeSpec(canary, primaryName, canaryName)
+	if err != nil {
+		return fmt.Errorf("HTTPProxy %s.%s spec error %v", targetName, canary.Namespace, err)
 	}
 
 	proxy, err := cr.contourClient.ProjectcontourV1().HTTPProxies(canary.Namespace).Get(targetName, metav1.GetOptions{})
@@ -135,16 +72,33 @@ func (cr *ContourRouter) Reconcile(canary *flaggerv1.Canary) error {
 		return fmt.Errorf("HTTPProxy %s.%s query error %v", targetName, canary.Namespace, err)
 	}
 
-	// update HTTPProxy but keep the original destination weights
+	// update HTTPProxy but keep the original destination weights and leave
+	// every route (or TCP proxy) that isn't driving the canary untouched
 	if proxy != nil {
+		clone := proxy.DeepCopy()
+
+		if isTCPCanary(canary) {
+			tcp := &contourv1.TCPProxy{Services: append([]contourv1.Service(nil), newSpec.TCPProxy.Services...)}
+			if clone.Spec.TCPProxy != nil {
+				if primaryIdx, canaryIdx, ok := serviceIndexes(clone.Spec.TCPProxy.Services, primaryName, canaryName); ok {
+					// keep the in-flight weights; only Name/Port come from
+					// the template
+					tcp.Services[0].Weight = clone.Spec.TCPProxy.Services[primaryIdx].Weight
+					tcp.Services[1].Weight = clone.Spec.TCPProxy.Services[canaryIdx].Weight
+				}
+			}
+			clone.Spec.TCPProxy = tcp
+		} else {
+			clone.Spec.Routes = reconcileRoutes(clone.Spec.Routes, newSpec.Routes, primaryName, canaryName)
+		}
+
+		// TCPProxy.Services and Route.Services share the same Service type, so
+		// this one IgnoreFields rule covers the canary weight in both shapes
 		if diff := cmp.Diff(
-			newSpec,
+			clone.Spec,
 			proxy.Spec,
 			cmpopts.IgnoreFields(contourv1.Service{}, "Weight"),
 		); diff != "" {
-			clone := proxy.DeepCopy()
-			clone.Spec = newSpec
-
 			_, err = cr.contourClient.ProjectcontourV1().HTTPProxies(canary.Namespace).Update(clone)
 			if err != nil {
 				return fmt.Errorf("HTTPProxy %s.%s update error %v", targetName, canary.Namespace, err)
@@ -157,7 +111,10 @@ func (cr *ContourRouter) Reconcile(canary *flaggerv1.Canary) error {
 	return nil
 }
 
-// GetRoutes returns the service weight for primary and canary
+// GetRoutes returns the service weight for primary and canary. For HTTP
+// canaries the weight is averaged across every route that carries the
+// primary/canary service pair, skipping routes whose two weights are both
+// zero; for TCP canaries it's read off the TCPProxy
 func (cr *ContourRouter) GetRoutes(canary *flaggerv1.Canary) (
 	primaryWeight int,
 	canaryWeight int,
@@ -166,6 +123,7 @@ func (cr *ContourRouter) GetRoutes(canary *flaggerv1.Canary) (
 ) {
 	targetName := canary.Spec.TargetRef.Name
 	primaryName := fmt.Sprintf("%s-primary", targetName)
+	canaryName := fmt.Sprintf("%s-canary", targetName)
 
 	proxy, err := cr.contourClient.ProjectcontourV1().HTTPProxies(canary.Namespace).Get(targetName, metav1.GetOptions{})
 	if err != nil {
@@ -177,23 +135,55 @@ func (cr *ContourRouter) GetRoutes(canary *flaggerv1.Canary) (
 		return
 	}
 
-	if len(proxy.Spec.Routes) < 1 || len(proxy.Spec.Routes[0].Services) < 2 {
+	if isTCPCanary(canary) {
+		if proxy.Spec.TCPProxy == nil {
+			err = fmt.Errorf("HTTPProxy %s.%s services not found", targetName, canary.Namespace)
+			return
+		}
+		primaryIdx, _, ok := serviceIndexes(proxy.Spec.TCPProxy.Services, primaryName, canaryName)
+		if !ok {
+			err = fmt.Errorf("HTTPProxy %s.%s services not found", targetName, canary.Namespace)
+			return
+		}
+		primaryWeight = int(proxy.Spec.TCPProxy.Services[primaryIdx].Weight)
+		canaryWeight = 100 - primaryWeight
+		return
+	}
+
+	matched := canaryRouteIndexes(proxy.Spec.Routes, primaryName, canaryName)
+	if len(matched) == 0 {
 		err = fmt.Errorf("HTTPProxy %s.%s services not found", targetName, canary.Namespace)
 		return
 	}
 
-	for _, dst := range proxy.Spec.Routes[0].Services {
-		if dst.Name == primaryName {
-			primaryWeight = int(dst.Weight)
-			canaryWeight = 100 - primaryWeight
-			return
+	var primaryPercentSum, counted int
+	for _, routeIdx := range matched {
+		primaryIdx, canaryIdx, _ := canaryServiceIndexes(proxy.Spec.Routes[routeIdx], primaryName, canaryName)
+		services := proxy.Spec.Routes[routeIdx].Services
+		total := int(services[primaryIdx].Weight + services[canaryIdx].Weight)
+		if total == 0 {
+			continue
 		}
+		primaryPercentSum += int(services[primaryIdx].Weight) * 100 / total
+		counted++
 	}
 
+	if counted == 0 {
+		err = fmt.Errorf("HTTPProxy %s.%s services not found", targetName, canary.Namespace)
+		return
+	}
+
+	primaryWeight = primaryPercentSum / counted
+	canaryWeight = 100 - primaryWeight
 	return
 }
 
-// SetRoutes updates the service weight for primary and canary
+// SetRoutes patches the service weight for primary and canary. For HTTP
+// canaries it patches every route that carries the primary/canary service
+// pair, scaling each route's split proportionally to its own existing total
+// weight; for TCP canaries it patches the TCPProxy services directly. It
+// only patches the affected weight fields so it doesn't race Contour's own
+// status writes or clobber routes/fields managed by someone else
 func (cr *ContourRouter) SetRoutes(
 	canary *flaggerv1.Canary,
 	primaryWeight int,
@@ -217,81 +207,311 @@ func (cr *ContourRouter) SetRoutes(
 		return fmt.Errorf("HTTPProxy %s.%s query error %v", targetName, canary.Namespace, err)
 	}
 
-	proxy.Spec = contourv1.HTTPProxySpec{
-		Routes: []contourv1.Route{
-			{
-				Conditions: []contourv1.Condition{
-					{
-						Prefix: cr.makePrefix(canary),
-					},
-				},
-				TimeoutPolicy: cr.makeTimeoutPolicy(canary),
-				RetryPolicy:   cr.makeRetryPolicy(canary),
+	var patch []byte
+	if isTCPCanary(canary) {
+		if proxy.Spec.TCPProxy == nil {
+			return fmt.Errorf("HTTPProxy %s.%s services not found", targetName, canary.Namespace)
+		}
+		if _, _, ok := serviceIndexes(proxy.Spec.TCPProxy.Services, primaryName, canaryName); !ok {
+			return fmt.Errorf("HTTPProxy %s.%s services not found", targetName, canary.Namespace)
+		}
+		patch, err = tcpWeightJSONPatch(proxy.Spec.TCPProxy.Services, primaryName, canaryName, primaryWeight, canaryWeight)
+	} else {
+		matched := canaryRouteIndexes(proxy.Spec.Routes, primaryName, canaryName)
+		if len(matched) == 0 {
+			return fmt.Errorf("HTTPProxy %s.%s services not found", targetName, canary.Namespace)
+		}
+		patch, err = weightJSONPatch(proxy.Spec.Routes, matched, primaryName, canaryName, primaryWeight, canaryWeight)
+	}
+	if err != nil {
+		return fmt.Errorf("HTTPProxy %s.%s patch build error %v", targetName, canary.Namespace, err)
+	}
+
+	_, err = cr.contourClient.ProjectcontourV1().HTTPProxies(canary.Namespace).
+		Patch(targetName, types.JSONPatchType, patch)
+	if err != nil {
+		return fmt.Errorf("HTTPProxy %s.%s update error %v", targetName, canary.Namespace, err)
+	}
+	return nil
+}
+
+// jsonPatchOp is a single RFC 6902 JSON Patch operation
+type jsonPatchOp struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+// scaledWeight scales weight (a 0-100 percentage) against a route's
+// existing total, so a route with a different denominator (e.g. 50 instead
+// of 100) shifts proportionally rather than snapping straight to weight
+func scaledWeight(weight, total int) int {
+	if total == 0 {
+		total = 100
+	}
+	return weight * total / 100
+}
+
+// weightJSONPatch builds a JSON Patch containing a "test" op asserting the
+// service name followed by a "replace" op for its weight, for each
+// primary/canary service in the routes listed in matched. Addressing by
+// array index alone would let a concurrent reorder/insert of spec.routes
+// between Get and Patch silently land the canary weight on the wrong
+// service; the leading "test" op makes that surface as a patch conflict
+// instead
+func weightJSONPatch(routes []contourv1.Route, matched []int, primaryName, canaryName string, primaryWeight, canaryWeight int) ([]byte, error) {
+	var ops []jsonPatchOp
+	for _, routeIdx := range matched {
+		primaryIdx, canaryIdx, ok := canaryServiceIndexes(routes[routeIdx], primaryName, canaryName)
+		if !ok {
+			continue
+		}
+		total := int(routes[routeIdx].Services[primaryIdx].Weight + routes[routeIdx].Services[canaryIdx].Weight)
+		ops = append(ops,
+			testServiceNameOp(fmt.Sprintf("/spec/routes/%d/services/%d", routeIdx, primaryIdx), primaryName),
+			jsonPatchOp{
+				Op:    "replace",
+				Path:  fmt.Sprintf("/spec/routes/%d/services/%d/weight", routeIdx, primaryIdx),
+				Value: scaledWeight(primaryWeight, total),
+			},
+			testServiceNameOp(fmt.Sprintf("/spec/routes/%d/services/%d", routeIdx, canaryIdx), canaryName),
+			jsonPatchOp{
+				Op:    "replace",
+				Path:  fmt.Sprintf("/spec/routes/%d/services/%d/weight", routeIdx, canaryIdx),
+				Value: scaledWeight(canaryWeight, total),
+			},
+		)
+	}
+
+	return json.Marshal(ops)
+}
+
+// testServiceNameOp builds a "test" op asserting that the service at
+// basePath still has the expected name, so a patch only applies if the
+// server's live object still matches what Get last returned
+func testServiceNameOp(basePath, name string) jsonPatchOp {
+	return jsonPatchOp{
+		Op:    "test",
+		Path:  basePath + "/name",
+		Value: name,
+	}
+}
+
+// tcpWeightJSONPatch builds a JSON Patch containing a "test" op asserting
+// the service name followed by a "replace" op for its weight, for the
+// primary/canary service pair of a TCPProxy
+func tcpWeightJSONPatch(services []contourv1.Service, primaryName, canaryName string, primaryWeight, canaryWeight int) ([]byte, error) {
+	primaryIdx, canaryIdx, ok := serviceIndexes(services, primaryName, canaryName)
+	if !ok {
+		return json.Marshal([]jsonPatchOp{})
+	}
+
+	total := int(services[primaryIdx].Weight + services[canaryIdx].Weight)
+	ops := []jsonPatchOp{
+		testServiceNameOp(fmt.Sprintf("/spec/tcpproxy/services/%d", primaryIdx), primaryName),
+		{
+			Op:    "replace",
+			Path:  fmt.Sprintf("/spec/tcpproxy/services/%d/weight", primaryIdx),
+			Value: scaledWeight(primaryWeight, total),
+		},
+		testServiceNameOp(fmt.Sprintf("/spec/tcpproxy/services/%d", canaryIdx), canaryName),
+		{
+			Op:    "replace",
+			Path:  fmt.Sprintf("/spec/tcpproxy/services/%d/weight", canaryIdx),
+			Value: scaledWeight(canaryWeight, total),
+		},
+	}
+
+	return json.Marshal(ops)
+}
+
+// serviceIndexes returns the index of the primary and canary service within
+// services, and whether both were found
+func serviceIndexes(services []contourv1.Service, primaryName, canaryName string) (primaryIdx, canaryIdx int, ok bool) {
+	primaryIdx, canaryIdx = -1, -1
+	for i, svc := range services {
+		switch svc.Name {
+		case primaryName:
+			primaryIdx = i
+		case canaryName:
+			canaryIdx = i
+		}
+	}
+	return primaryIdx, canaryIdx, primaryIdx > -1 && canaryIdx > -1
+}
+
+// canaryServiceIndexes returns the index of the primary and canary service
+// within route.Services, and whether both were found
+func canaryServiceIndexes(route contourv1.Route, primaryName, canaryName string) (primaryIdx, canaryIdx int, ok bool) {
+	return serviceIndexes(route.Services, primaryName, canaryName)
+}
+
+// canaryRouteIndexes returns the index of every route that carries the
+// primary/canary service pair
+func canaryRouteIndexes(routes []contourv1.Route, primaryName, canaryName string) []int {
+	var indexes []int
+	for i, route := range routes {
+		if _, _, ok := canaryServiceIndexes(route, primaryName, canaryName); ok {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+// reconcileRoutes returns the routes Reconcile should persist for an
+// existing HTTPProxy. It rewrites only the Conditions/TimeoutPolicy/
+// RetryPolicy of the default route and, if present, the header-match route
+// Flagger itself created, and creates or drops just those two routes as the
+// desired shape grows or shrinks between one and two templates. Any other
+// route that merely happens to reference the primary/canary pair - e.g. a
+// user-authored CORS or header route - is left exactly as-is: there is no
+// index correspondence between Flagger's 1-2 templates and an arbitrary
+// matched route, so it can be neither reshaped nor deleted
+func reconcileRoutes(existing, templates []contourv1.Route, primaryName, canaryName string) []contourv1.Route {
+	defaultTmpl := templates[len(templates)-1]
+	prefix := defaultTmpl.Conditions[0].Prefix
+
+	matched := canaryRouteIndexes(existing, primaryName, canaryName)
+	defaultIdx, matchIdx := ownedRouteIndexes(existing, matched, prefix)
+
+	routes := append([]contourv1.Route(nil), existing...)
+
+	applyTemplate := func(idx int, tmpl contourv1.Route) {
+		routes[idx].Conditions = tmpl.Conditions
+		routes[idx].TimeoutPolicy = tmpl.TimeoutPolicy
+		routes[idx].RetryPolicy = tmpl.RetryPolicy
+	}
+
+	wantMatch := len(templates) == 2
+
+	if wantMatch {
+		if matchIdx > -1 {
+			applyTemplate(matchIdx, templates[0])
+		} else {
+			routes = append(routes, templates[0])
+		}
+	} else if matchIdx > -1 {
+		routes = append(routes[:matchIdx], routes[matchIdx+1:]...)
+		if defaultIdx > matchIdx {
+			defaultIdx--
+		}
+	}
+
+	if defaultIdx > -1 {
+		applyTemplate(defaultIdx, defaultTmpl)
+	} else {
+		routes = append(routes, defaultTmpl)
+	}
+
+	return routes
+}
+
+// ownedRouteIndexes picks out, among the routes carrying the primary/canary
+// pair, the one Flagger created as its header-match route (if any) and the
+// one it created as its default/fallback route, so reconcileRoutes can
+// reshape the route count without assuming every matched route belongs to
+// Flagger. Every route Flagger generates starts with the same Prefix
+// condition (see makeConditions): the default route has that as its only
+// condition, the match route has header conditions appended after it. A
+// matched route whose first condition isn't that exact prefix - e.g. a
+// user's own route that happens to reference the same services under a
+// different path - fits neither and is left alone
+func ownedRouteIndexes(routes []contourv1.Route, matched []int, prefix string) (defaultIdx, matchIdx int) {
+	defaultIdx, matchIdx = -1, -1
+	for _, idx := range matched {
+		conditions := routes[idx].Conditions
+		if len(conditions) == 0 || conditions[0].Header != nil || conditions[0].Prefix != prefix {
+			continue
+		}
+		if len(conditions) == 1 {
+			if defaultIdx == -1 {
+				defaultIdx = idx
+			}
+		} else if matchIdx == -1 {
+			matchIdx = idx
+		}
+	}
+	return defaultIdx, matchIdx
+}
+
+// isTCPCanary reports whether the canary targets a TCP service, in which
+// case Flagger must drive a TCPProxy instead of weighted HTTP routes
+func isTCPCanary(canary *flaggerv1.Canary) bool {
+	if canary.Spec.Service.AppProtocol == "tcp" {
+		return true
+	}
+	return strings.HasPrefix(canary.Spec.Service.PortName, "tcp-")
+}
+
+// makeSpec builds the desired HTTPProxySpec for a canary: either a TCPProxy
+// with a primary/canary service pair, or one or two HTTP routes
+func (cr *ContourRouter) makeSpec(canary *flaggerv1.Canary, primaryName, canaryName string) (contourv1.HTTPProxySpec, error) {
+	if isTCPCanary(canary) {
+		return contourv1.HTTPProxySpec{
+			TCPProxy: &contourv1.TCPProxy{
 				Services: []contourv1.Service{
 					{
 						Name:   primaryName,
 						Port:   int(canary.Spec.Service.Port),
-						Weight: uint32(primaryWeight),
+						Weight: uint32(100),
 					},
 					{
 						Name:   canaryName,
 						Port:   int(canary.Spec.Service.Port),
-						Weight: uint32(canaryWeight),
+						Weight: uint32(0),
 					},
-				}},
-		},
+				},
+			},
+		}, nil
 	}
 
-	if len(canary.Spec.CanaryAnalysis.Match) > 0 {
-		proxy.Spec = contourv1.HTTPProxySpec{
-			Routes: []contourv1.Route{
-				{
-					Conditions:    cr.makeConditions(canary),
-					TimeoutPolicy: cr.makeTimeoutPolicy(canary),
-					RetryPolicy:   cr.makeRetryPolicy(canary),
-					Services: []contourv1.Service{
-						{
-							Name:   primaryName,
-							Port:   int(canary.Spec.Service.Port),
-							Weight: uint32(primaryWeight),
-						},
-						{
-							Name:   canaryName,
-							Port:   int(canary.Spec.Service.Port),
-							Weight: uint32(canaryWeight),
-						},
-					},
-				},
-				{
-					Conditions: []contourv1.Condition{
-						{
-							Prefix: cr.makePrefix(canary),
-						},
-					},
-					TimeoutPolicy: cr.makeTimeoutPolicy(canary),
-					RetryPolicy:   cr.makeRetryPolicy(canary),
-					Services: []contourv1.Service{
-						{
-							Name:   primaryName,
-							Port:   int(canary.Spec.Service.Port),
-							Weight: uint32(100),
-						},
-						{
-							Name:   canaryName,
-							Port:   int(canary.Spec.Service.Port),
-							Weight: uint32(0),
-						},
-					},
-				},
+	routes, err := cr.makeRouteTemplates(canary, primaryName, canaryName)
+	if err != nil {
+		return contourv1.HTTPProxySpec{}, err
+	}
+
+	return contourv1.HTTPProxySpec{Routes: routes}, nil
+}
+
+// makeRouteTemplates builds the desired route shape(s) for a canary: a
+// single default route, or a header-matched route plus a default fallback
+// route when the analysis defines header matches
+func (cr *ContourRouter) makeRouteTemplates(canary *flaggerv1.Canary, primaryName, canaryName string) ([]contourv1.Route, error) {
+	defaultRoute := contourv1.Route{
+		Conditions: []contourv1.Condition{
+			{
+				Prefix: cr.makePrefix(canary),
 			},
-		}
+		},
+		TimeoutPolicy: cr.makeTimeoutPolicy(canary),
+		RetryPolicy:   cr.makeRetryPolicy(canary),
+		Services: []contourv1.Service{
+			{
+				Name:   primaryName,
+				Port:   int(canary.Spec.Service.Port),
+				Weight: uint32(100),
+			},
+			{
+				Name:   canaryName,
+				Port:   int(canary.Spec.Service.Port),
+				Weight: uint32(0),
+			},
+		},
 	}
 
-	_, err = cr.contourClient.ProjectcontourV1().HTTPProxies(canary.Namespace).Update(proxy)
+	if len(canary.Spec.CanaryAnalysis.Match) == 0 && len(canary.Spec.CanaryAnalysis.NotMatch) == 0 {
+		return []contourv1.Route{defaultRoute}, nil
+	}
+
+	conditions, err := cr.makeConditions(canary)
 	if err != nil {
-		return fmt.Errorf("HTTPProxy %s.%s update error %v", targetName, canary.Namespace, err)
+		return nil, err
 	}
-	return nil
+
+	matchRoute := defaultRoute
+	matchRoute.Conditions = conditions
+
+	return []contourv1.Route{matchRoute, defaultRoute}, nil
 }
 
 func (cr *ContourRouter) makePrefix(canary *flaggerv1.Canary) string {
@@ -306,43 +526,85 @@ func (cr *ContourRouter) makePrefix(canary *flaggerv1.Canary) string {
 	return prefix
 }
 
-func (cr *ContourRouter) makeConditions(canary *flaggerv1.Canary) []contourv1.Condition {
-	list := []contourv1.Condition{}
-
-	if len(canary.Spec.CanaryAnalysis.Match) > 0 {
-		for _, match := range canary.Spec.CanaryAnalysis.Match {
-			for s, stringMatch := range match.Headers {
-				h := &contourv1.HeaderCondition{
-					Name:  s,
-					Exact: stringMatch.Exact,
-				}
-				if stringMatch.Suffix != "" {
-					h = &contourv1.HeaderCondition{
-						Name:     s,
-						Contains: stringMatch.Suffix,
-					}
-				}
-				if stringMatch.Prefix != "" {
-					h = &contourv1.HeaderCondition{
-						Name:     s,
-						Contains: stringMatch.Prefix,
-					}
-				}
-				list = append(list, contourv1.Condition{
-					Prefix: cr.makePrefix(canary),
-					Header: h,
-				})
-			}
-		}
-	} else {
-		list = []contourv1.Condition{
+// makeConditions translates a canary's Match/NotMatch header rules into a
+// single route's Conditions. All conditions on a route are ANDed by
+// Contour, so every header of a given match (plus the path prefix) must
+// live in the same route for "all headers match" semantics
+func (cr *ContourRouter) makeConditions(canary *flaggerv1.Canary) ([]contourv1.Condition, error) {
+	if len(canary.Spec.CanaryAnalysis.Match) == 0 && len(canary.Spec.CanaryAnalysis.NotMatch) == 0 {
+		return []contourv1.Condition{
 			{
 				Prefix: cr.makePrefix(canary),
 			},
+		}, nil
+	}
+
+	list := []contourv1.Condition{
+		{
+			Prefix: cr.makePrefix(canary),
+		},
+	}
+
+	for _, match := range canary.Spec.CanaryAnalysis.Match {
+		for name, stringMatch := range match.Headers {
+			h, err := makeHeaderCondition(name, stringMatch, false)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, contourv1.Condition{Header: h})
+		}
+	}
+
+	for _, match := range canary.Spec.CanaryAnalysis.NotMatch {
+		for name, stringMatch := range match.Headers {
+			h, err := makeHeaderCondition(name, stringMatch, true)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, contourv1.Condition{Header: h})
+		}
+	}
+
+	return list, nil
+}
+
+// makeHeaderCondition translates a Flagger StringMatch into a Contour
+// HeaderCondition. negate selects the "not" equivalent for a NotMatch
+// stanza.
+//
+// contourv1.HeaderCondition only exposes Present/Contains/NotContains/
+// Exact/NotExact - there is no Regex or anchor field - so Prefix and Suffix
+// can only be approximated with Contains, and an arbitrary Regex can't be
+// translated at all. Negating that approximation isn't equivalent to the
+// real negated Prefix/Suffix semantics (NotMatch{Prefix: "foo"} must still
+// match "barfoo", but NotContains("foo") would reject it too), so negated
+// Prefix/Suffix are rejected rather than silently mis-routing traffic, and
+// Regex is rejected outright since Contains can't express it at all
+func makeHeaderCondition(name string, stringMatch flaggerv1.StringMatch, negate bool) (*contourv1.HeaderCondition, error) {
+	h := &contourv1.HeaderCondition{Name: name}
+
+	switch {
+	case stringMatch.Exact != "":
+		if negate {
+			h.NotExact = stringMatch.Exact
+		} else {
+			h.Exact = stringMatch.Exact
+		}
+	case stringMatch.Prefix != "":
+		if negate {
+			return nil, fmt.Errorf("header %q: NotMatch does not support Prefix, Contour's HeaderCondition has no anchor to negate it precisely: use Exact instead", name)
+		}
+		h.Contains = stringMatch.Prefix
+	case stringMatch.Suffix != "":
+		if negate {
+			return nil, fmt.Errorf("header %q: NotMatch does not support Suffix, Contour's HeaderCondition has no anchor to negate it precisely: use Exact instead", name)
 		}
+		h.Contains = stringMatch.Suffix
+	case stringMatch.Regex != "":
+		return nil, fmt.Errorf("header %q: Regex is not supported, Contour's HeaderCondition has no regex field: use Exact, Prefix or Suffix instead", name)
 	}
 
-	return list
+	return h, nil
 }
 
 func (cr *ContourRouter) makeTimeoutPolicy(canary *flaggerv1.Canary) *contourv1.TimeoutPolicy {
@@ -0,0 +1,407 @@
+package router
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"go.uber.org/zap"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	flaggerv1 "github.com/weaveworks/flagger/pkg/apis/flagger/v1alpha3"
+	contourv1 "github.com/weaveworks/flagger/pkg/apis/projectcontour/v1"
+	fakeClientset "github.com/weaveworks/flagger/pkg/client/clientset/versioned/fake"
+)
+
+// TestReconcileRoutesPreservesForeignRoutes exercises the scenario the
+// route-count reconciliation logic most needs to get right: an HTTPProxy
+// with several pre-existing routes that carry the primary/canary service
+// pair, only one of which Flagger actually owns. Reconciling must leave the
+// others - including their position in the slice - completely untouched
+// rather than assuming every matched route is one of its own 1-2 templates
+func TestReconcileRoutesPreservesForeignRoutes(t *testing.T) {
+	const primaryName, canaryName = "podinfo-primary", "podinfo-canary"
+
+	foreignHeaderRoute := contourv1.Route{
+		Conditions: []contourv1.Condition{
+			{Prefix: "/api"},
+			{Header: &contourv1.HeaderCondition{Name: "x-team", Exact: "payments"}},
+		},
+		Services: []contourv1.Service{
+			{Name: primaryName, Port: 80, Weight: 80},
+			{Name: canaryName, Port: 80, Weight: 20},
+		},
+	}
+	ownedDefaultRoute := contourv1.Route{
+		Conditions: []contourv1.Condition{{Prefix: "/"}},
+		Services: []contourv1.Service{
+			{Name: primaryName, Port: 80, Weight: 60},
+			{Name: canaryName, Port: 80, Weight: 40},
+		},
+	}
+	unrelatedRoute := contourv1.Route{
+		Conditions: []contourv1.Condition{{Prefix: "/healthz"}},
+		Services:   []contourv1.Service{{Name: "podinfo-health", Port: 80, Weight: 100}},
+	}
+
+	existing := []contourv1.Route{foreignHeaderRoute, ownedDefaultRoute, unrelatedRoute}
+
+	cr := &ContourRouter{}
+	templates, err := cr.makeRouteTemplates(&flaggerv1.Canary{
+		Spec: flaggerv1.CanarySpec{Service: flaggerv1.CanaryService{Port: 80}},
+	}, primaryName, canaryName)
+	if err != nil {
+		t.Fatalf("makeRouteTemplates() error = %v", err)
+	}
+
+	got := reconcileRoutes(existing, templates, primaryName, canaryName)
+
+	if len(got) != len(existing) {
+		t.Fatalf("reconcileRoutes() changed route count: got %d routes, want %d", len(got), len(existing))
+	}
+	if diff := cmp.Diff(foreignHeaderRoute, got[0]); diff != "" {
+		t.Errorf("foreign header route was modified (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(unrelatedRoute, got[2]); diff != "" {
+		t.Errorf("unrelated route was modified (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(templates[0].Conditions, got[1].Conditions); diff != "" {
+		t.Errorf("owned default route conditions not refreshed (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(ownedDefaultRoute.Services, got[1].Services); diff != "" {
+		t.Errorf("owned default route weights should be untouched by reconcileRoutes (-want +got):\n%s", diff)
+	}
+}
+
+// TestReconcileRoutesAddsAndDropsOwnedMatchRoute checks that a second,
+// Flagger-owned match route is added when the desired shape grows to two
+// templates and removed again when it shrinks back to one, without
+// disturbing an unrelated matched route sitting ahead of them
+func TestReconcileRoutesAddsAndDropsOwnedMatchRoute(t *testing.T) {
+	const primaryName, canaryName = "podinfo-primary", "podinfo-canary"
+
+	foreignRoute := contourv1.Route{
+		Conditions: []contourv1.Condition{{Prefix: "/legacy"}},
+		Services: []contourv1.Service{
+			{Name: primaryName, Port: 80, Weight: 50},
+			{Name: canaryName, Port: 80, Weight: 50},
+		},
+	}
+	ownedDefaultRoute := contourv1.Route{
+		Conditions: []contourv1.Condition{{Prefix: "/"}},
+		Services: []contourv1.Service{
+			{Name: primaryName, Port: 80, Weight: 100},
+			{Name: canaryName, Port: 80, Weight: 0},
+		},
+	}
+
+	cr := &ContourRouter{}
+	canary := &flaggerv1.Canary{
+		Spec: flaggerv1.CanarySpec{
+			Service: flaggerv1.CanaryService{Port: 80},
+			CanaryAnalysis: flaggerv1.CanaryAnalysis{
+				Match: []flaggerv1.CanaryMatch{
+					{Headers: map[string]flaggerv1.StringMatch{"x-canary": {Exact: "always"}}},
+				},
+			},
+		},
+	}
+	templatesWithMatch, err := cr.makeRouteTemplates(canary, primaryName, canaryName)
+	if err != nil {
+		t.Fatalf("makeRouteTemplates() error = %v", err)
+	}
+
+	grown := reconcileRoutes([]contourv1.Route{foreignRoute, ownedDefaultRoute}, templatesWithMatch, primaryName, canaryName)
+	if len(grown) != 3 {
+		t.Fatalf("reconcileRoutes() grown len = %d, want 3", len(grown))
+	}
+	if diff := cmp.Diff(foreignRoute, grown[0]); diff != "" {
+		t.Errorf("foreign route was modified while adding the match route (-want +got):\n%s", diff)
+	}
+
+	templatesWithoutMatch, err := cr.makeRouteTemplates(&flaggerv1.Canary{
+		Spec: flaggerv1.CanarySpec{Service: flaggerv1.CanaryService{Port: 80}},
+	}, primaryName, canaryName)
+	if err != nil {
+		t.Fatalf("makeRouteTemplates() error = %v", err)
+	}
+
+	shrunk := reconcileRoutes(grown, templatesWithoutMatch, primaryName, canaryName)
+	if len(shrunk) != 2 {
+		t.Fatalf("reconcileRoutes() shrunk len = %d, want 2", len(shrunk))
+	}
+	if diff := cmp.Diff(foreignRoute, shrunk[0]); diff != "" {
+		t.Errorf("foreign route was modified while dropping the match route (-want +got):\n%s", diff)
+	}
+}
+
+// TestWeightJSONPatch checks that each matched route yields a test op
+// asserting the service name followed by a replace op for its weight, and
+// that a route whose existing total isn't 100 gets its split scaled
+// proportionally rather than set to the raw requested percentage
+func TestWeightJSONPatch(t *testing.T) {
+	const primaryName, canaryName = "podinfo-primary", "podinfo-canary"
+
+	routes := []contourv1.Route{
+		{
+			Services: []contourv1.Service{
+				{Name: primaryName, Weight: 100},
+				{Name: canaryName, Weight: 0},
+			},
+		},
+		{
+			Services: []contourv1.Service{
+				{Name: primaryName, Weight: 25},
+				{Name: canaryName, Weight: 25},
+			},
+		},
+	}
+
+	patch, err := weightJSONPatch(routes, []int{0, 1}, primaryName, canaryName, 60, 40)
+	if err != nil {
+		t.Fatalf("weightJSONPatch() error = %v", err)
+	}
+
+	var ops []jsonPatchOp
+	if err := json.Unmarshal(patch, &ops); err != nil {
+		t.Fatalf("patch did not unmarshal: %v", err)
+	}
+
+	want := []jsonPatchOp{
+		{Op: "test", Path: "/spec/routes/0/services/0/name", Value: primaryName},
+		{Op: "replace", Path: "/spec/routes/0/services/0/weight", Value: float64(60)},
+		{Op: "test", Path: "/spec/routes/0/services/1/name", Value: canaryName},
+		{Op: "replace", Path: "/spec/routes/0/services/1/weight", Value: float64(40)},
+		{Op: "test", Path: "/spec/routes/1/services/0/name", Value: primaryName},
+		{Op: "replace", Path: "/spec/routes/1/services/0/weight", Value: float64(30)},
+		{Op: "test", Path: "/spec/routes/1/services/1/name", Value: canaryName},
+		{Op: "replace", Path: "/spec/routes/1/services/1/weight", Value: float64(20)},
+	}
+
+	if diff := cmp.Diff(want, ops); diff != "" {
+		t.Errorf("weightJSONPatch() ops mismatch (-want +got):\n%s", diff)
+	}
+}
+
+// TestTCPWeightJSONPatch checks the TCPProxy equivalent of
+// TestWeightJSONPatch: a test+replace op pair per service, addressed under
+// /spec/tcpproxy/services instead of /spec/routes/N/services
+func TestTCPWeightJSONPatch(t *testing.T) {
+	const primaryName, canaryName = "podinfo-primary", "podinfo-canary"
+
+	services := []contourv1.Service{
+		{Name: primaryName, Weight: 80},
+		{Name: canaryName, Weight: 20},
+	}
+
+	patch, err := tcpWeightJSONPatch(services, primaryName, canaryName, 70, 30)
+	if err != nil {
+		t.Fatalf("tcpWeightJSONPatch() error = %v", err)
+	}
+
+	var ops []jsonPatchOp
+	if err := json.Unmarshal(patch, &ops); err != nil {
+		t.Fatalf("patch did not unmarshal: %v", err)
+	}
+
+	want := []jsonPatchOp{
+		{Op: "test", Path: "/spec/tcpproxy/services/0/name", Value: primaryName},
+		{Op: "replace", Path: "/spec/tcpproxy/services/0/weight", Value: float64(70)},
+		{Op: "test", Path: "/spec/tcpproxy/services/1/name", Value: canaryName},
+		{Op: "replace", Path: "/spec/tcpproxy/services/1/weight", Value: float64(30)},
+	}
+
+	if diff := cmp.Diff(want, ops); diff != "" {
+		t.Errorf("tcpWeightJSONPatch() ops mismatch (-want +got):\n%s", diff)
+	}
+}
+
+// TestTCPWeightJSONPatchMissingService checks that tcpWeightJSONPatch
+// degrades to an empty, no-op patch rather than erroring or panicking when
+// the primary/canary pair isn't present
+func TestTCPWeightJSONPatchMissingService(t *testing.T) {
+	patch, err := tcpWeightJSONPatch(nil, "podinfo-primary", "podinfo-canary", 50, 50)
+	if err != nil {
+		t.Fatalf("tcpWeightJSONPatch() error = %v", err)
+	}
+	if string(patch) != "[]" {
+		t.Errorf("tcpWeightJSONPatch() with no matching services = %s, want an empty patch", patch)
+	}
+}
+
+// TestIsTCPCanary checks both ways a canary can be marked TCP - an explicit
+// "tcp" AppProtocol or a "tcp-" prefixed PortName - alongside the HTTP
+// default
+func TestIsTCPCanary(t *testing.T) {
+	tests := []struct {
+		name    string
+		service flaggerv1.CanaryService
+		want    bool
+	}{
+		{"appProtocol tcp", flaggerv1.CanaryService{AppProtocol: "tcp"}, true},
+		{"portName tcp- prefix", flaggerv1.CanaryService{PortName: "tcp-podinfo"}, true},
+		{"http port name", flaggerv1.CanaryService{PortName: "http"}, false},
+		{"unset", flaggerv1.CanaryService{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			canary := &flaggerv1.Canary{Spec: flaggerv1.CanarySpec{Service: tt.service}}
+			if got := isTCPCanary(canary); got != tt.want {
+				t.Errorf("isTCPCanary() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestContourRouterTCPRoundTrip drives a TCP canary through Reconcile,
+// GetRoutes and SetRoutes against a fake HTTPProxy, and checks that a
+// second Reconcile - called every reconciliation loop alongside the
+// in-flight analysis - doesn't reset the weights SetRoutes already wrote
+// back to the 100/0 template
+func TestContourRouterTCPRoundTrip(t *testing.T) {
+	canary := &flaggerv1.Canary{
+		ObjectMeta: metav1.ObjectMeta{Name: "podinfo", Namespace: "test"},
+		Spec: flaggerv1.CanarySpec{
+			TargetRef: flaggerv1.LocalObjectReference{Name: "podinfo"},
+			Service:   flaggerv1.CanaryService{Port: 9898, PortName: "tcp-podinfo"},
+		},
+	}
+
+	router := &ContourRouter{
+		contourClient: fakeClientset.NewSimpleClientset(),
+		logger:        zap.NewNop().Sugar(),
+	}
+
+	if err := router.Reconcile(canary); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+
+	primaryWeight, canaryWeight, _, err := router.GetRoutes(canary)
+	if err != nil {
+		t.Fatalf("GetRoutes() after create error = %v", err)
+	}
+	if primaryWeight != 100 || canaryWeight != 0 {
+		t.Fatalf("GetRoutes() after create = %d/%d, want 100/0", primaryWeight, canaryWeight)
+	}
+
+	if err := router.SetRoutes(canary, 60, 40, false); err != nil {
+		t.Fatalf("SetRoutes() error = %v", err)
+	}
+
+	primaryWeight, canaryWeight, _, err = router.GetRoutes(canary)
+	if err != nil {
+		t.Fatalf("GetRoutes() after SetRoutes error = %v", err)
+	}
+	if primaryWeight != 60 || canaryWeight != 40 {
+		t.Fatalf("GetRoutes() after SetRoutes = %d/%d, want 60/40", primaryWeight, canaryWeight)
+	}
+
+	if err := router.Reconcile(canary); err != nil {
+		t.Fatalf("second Reconcile() error = %v", err)
+	}
+
+	primaryWeight, canaryWeight, _, err = router.GetRoutes(canary)
+	if err != nil {
+		t.Fatalf("GetRoutes() after second Reconcile error = %v", err)
+	}
+	if primaryWeight != 60 || canaryWeight != 40 {
+		t.Errorf("second Reconcile() reset the in-flight TCPProxy weight to %d/%d, want 60/40 preserved", primaryWeight, canaryWeight)
+	}
+}
+
+// TestMakeHeaderCondition exercises every StringMatch variant against both
+// a Match and a NotMatch stanza. Prefix/Suffix/Regex can't be negated
+// faithfully with the fields contourv1.HeaderCondition actually exposes, so
+// those combinations must return an error instead of emitting a wrong
+// condition; Regex also has no positive translation at all
+func TestMakeHeaderCondition(t *testing.T) {
+	tests := []struct {
+		name        string
+		stringMatch flaggerv1.StringMatch
+		negate      bool
+		want        *contourv1.HeaderCondition
+		wantErr     bool
+	}{
+		{
+			name:        "exact",
+			stringMatch: flaggerv1.StringMatch{Exact: "payments"},
+			want:        &contourv1.HeaderCondition{Name: "x-team", Exact: "payments"},
+		},
+		{
+			name:        "negated exact maps to NotExact",
+			stringMatch: flaggerv1.StringMatch{Exact: "payments"},
+			negate:      true,
+			want:        &contourv1.HeaderCondition{Name: "x-team", NotExact: "payments"},
+		},
+		{
+			name:        "prefix approximated with Contains",
+			stringMatch: flaggerv1.StringMatch{Prefix: "pay"},
+			want:        &contourv1.HeaderCondition{Name: "x-team", Contains: "pay"},
+		},
+		{
+			name:        "negated prefix is rejected",
+			stringMatch: flaggerv1.StringMatch{Prefix: "pay"},
+			negate:      true,
+			wantErr:     true,
+		},
+		{
+			name:        "suffix approximated with Contains",
+			stringMatch: flaggerv1.StringMatch{Suffix: "ments"},
+			want:        &contourv1.HeaderCondition{Name: "x-team", Contains: "ments"},
+		},
+		{
+			name:        "negated suffix is rejected",
+			stringMatch: flaggerv1.StringMatch{Suffix: "ments"},
+			negate:      true,
+			wantErr:     true,
+		},
+		{
+			name:        "regex is rejected",
+			stringMatch: flaggerv1.StringMatch{Regex: "^pay.*"},
+			wantErr:     true,
+		},
+		{
+			name:        "negated regex is rejected",
+			stringMatch: flaggerv1.StringMatch{Regex: "^pay.*"},
+			negate:      true,
+			wantErr:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := makeHeaderCondition("x-team", tt.stringMatch, tt.negate)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("makeHeaderCondition() error = nil, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("makeHeaderCondition() error = %v", err)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("makeHeaderCondition() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestScaledWeight(t *testing.T) {
+	tests := []struct {
+		name          string
+		weight, total int
+		want          int
+	}{
+		{"full total", 60, 100, 60},
+		{"half total", 60, 50, 30},
+		{"zero total defaults to a 100 denominator", 60, 0, 60},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := scaledWeight(tt.weight, tt.total); got != tt.want {
+				t.Errorf("scaledWeight(%d, %d) = %d, want %d", tt.weight, tt.total, got, tt.want)
+			}
+		})
+	}
+}